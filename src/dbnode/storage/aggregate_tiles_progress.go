@@ -0,0 +1,196 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"time"
+)
+
+// AggregateTilesEvent reports the progress of a single shard/block within an
+// AggregateTiles run. A terminal event with Done set to true is sent once
+// the whole run (all shards and blocks) has finished.
+type AggregateTilesEvent struct {
+	Shard           uint32
+	BlockStart      time.Time
+	SeriesProcessed int64
+	SeriesWritten   int64
+	Errors          int64
+	ElapsedNanos    int64
+
+	// Done marks the terminal event sent once the AggregateTiles run has
+	// finished processing every shard and block; the per-shard fields above
+	// are zero on this event; use the events accumulated beforehand for
+	// totals.
+	Done bool
+}
+
+// AggregateTilesOptionsWithProgress bundles AggregateTilesOptions with a
+// sink that Run streams AggregateTilesEvents to as each shard/block
+// completes, so operators can build progress dashboards or cancel mid-run
+// via context.Context rather than polling tally counters for completion.
+// DB.AggregateTiles takes only AggregateTilesOptions and sends no events.
+type AggregateTilesOptionsWithProgress struct {
+	AggregateTilesOptions
+
+	ProgressSink chan<- AggregateTilesEvent
+}
+
+// WithProgressSink returns an AggregateTilesOptionsWithProgress wrapping o
+// and streaming progress to sink.
+func (o AggregateTilesOptions) WithProgressSink(sink chan<- AggregateTilesEvent) AggregateTilesOptionsWithProgress {
+	return AggregateTilesOptionsWithProgress{AggregateTilesOptions: o, ProgressSink: sink}
+}
+
+// NewAggregateTilesOptionsWithProgressSink builds an
+// AggregateTilesOptionsWithProgress from the same time-range/step arguments
+// as NewAggregateTilesOptions, plus the sink to stream progress to.
+func NewAggregateTilesOptionsWithProgressSink(
+	start, end time.Time,
+	step time.Duration,
+	insOptimizations bool,
+	sink chan<- AggregateTilesEvent,
+) (AggregateTilesOptionsWithProgress, error) {
+	base, err := NewAggregateTilesOptions(start, end, step, insOptimizations)
+	if err != nil {
+		return AggregateTilesOptionsWithProgress{}, err
+	}
+
+	return base.WithProgressSink(sink), nil
+}
+
+// ShardBlockResult is what a single shard/block processing step within an
+// AggregateTiles run reports back to Run.
+type ShardBlockResult struct {
+	SeriesProcessed int64
+	SeriesWritten   int64
+}
+
+// ShardBlockProcessor processes one shard/block within an AggregateTiles
+// run, for the step-sized tile window starting at blockStart: a caller's
+// per-shard/block tile aggregation, optionally composed with rollup rule
+// evaluation via AggregateTilesWithRollupRulesOptions.ShardBlockStep. Run
+// wraps it with progress reporting.
+type ShardBlockProcessor func(ctx context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error)
+
+// Run calls process once for every (shard, tile window) pair - every shard
+// in shards, crossed with every step-sized tile window between
+// o.AggregateTilesOptions' start and end - streaming an AggregateTilesEvent
+// to o.ProgressSink after each call, and a terminal Done event once every
+// pair has been processed. A per-shard/block error is recorded on that
+// event's Errors field rather than aborting the run, so one bad shard/block
+// doesn't stop progress reporting for the rest; Run keeps going and returns
+// the first such error once every pair has been attempted. If o.ProgressSink
+// is nil, Run still calls process for every pair but sends nothing.
+//
+// Cancelling ctx stops Run before its next shard/block: it neither starts
+// processing another pair nor blocks forever handing an event to a sink
+// whose consumer stopped draining it on cancellation (the natural pattern
+// for "cancel mid-run"). Run returns ctx.Err() in that case, unless an
+// earlier per-shard/block error already claimed the return slot.
+func (o AggregateTilesOptionsWithProgress) Run(
+	ctx context.Context,
+	shards []uint32,
+	start, end time.Time,
+	step time.Duration,
+	process ShardBlockProcessor,
+) (int64, error) {
+	if o.ProgressSink != nil {
+		defer o.send(ctx, AggregateTilesEvent{Done: true})
+	}
+
+	var (
+		processed int64
+		firstErr  error
+	)
+
+runLoop:
+	for _, shard := range shards {
+		for blockStart := start; blockStart.Before(end); blockStart = blockStart.Add(step) {
+			select {
+			case <-ctx.Done():
+				firstErr = recordErr(firstErr, ctx.Err())
+				break runLoop
+			default:
+			}
+
+			begin := time.Now()
+			result, err := process(ctx, shard, blockStart)
+
+			event := AggregateTilesEvent{
+				Shard:           shard,
+				BlockStart:      blockStart,
+				SeriesProcessed: result.SeriesProcessed,
+				SeriesWritten:   result.SeriesWritten,
+				ElapsedNanos:    time.Since(begin).Nanoseconds(),
+			}
+			if err != nil {
+				event.Errors = 1
+				firstErr = recordErr(firstErr, err)
+			}
+
+			processed++
+
+			if !o.send(ctx, event) {
+				firstErr = recordErr(firstErr, ctx.Err())
+				break runLoop
+			}
+		}
+	}
+
+	return processed, firstErr
+}
+
+// send delivers event to o.ProgressSink, reporting false instead of blocking
+// forever if ctx is cancelled before the sink accepts it. A nil
+// o.ProgressSink always reports true without sending anything. The sink is
+// tried first without blocking so that a cancellation racing with room in
+// the sink still delivers the event - send only gives up once it would
+// otherwise have to block.
+func (o AggregateTilesOptionsWithProgress) send(ctx context.Context, event AggregateTilesEvent) bool {
+	if o.ProgressSink == nil {
+		return true
+	}
+
+	select {
+	case o.ProgressSink <- event:
+		return true
+	default:
+	}
+
+	select {
+	case o.ProgressSink <- event:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// recordErr returns existing if it's already set, otherwise next - so the
+// first error Run encounters, whether from process or ctx cancellation,
+// wins and later ones don't overwrite it.
+func recordErr(existing, next error) error {
+	if existing != nil {
+		return existing
+	}
+
+	return next
+}
@@ -0,0 +1,194 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAggregateTilesOptionsWithProgressSink(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	base, err := NewAggregateTilesOptions(start, start.Add(6*time.Hour), time.Hour, false)
+	require.NoError(t, err)
+
+	sink := make(chan AggregateTilesEvent, 1)
+	opts := base.WithProgressSink(sink)
+	assert.Equal(t, base, opts.AggregateTilesOptions)
+
+	opts.ProgressSink <- AggregateTilesEvent{Shard: 1, SeriesWritten: 3}
+	event := <-sink
+	assert.Equal(t, uint32(1), event.Shard)
+	assert.Equal(t, int64(3), event.SeriesWritten)
+}
+
+func TestNewAggregateTilesOptionsWithProgressSink(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	sink := make(chan AggregateTilesEvent, 1)
+
+	opts, err := NewAggregateTilesOptionsWithProgressSink(
+		start, start.Add(6*time.Hour), time.Hour, false, sink)
+	require.NoError(t, err)
+
+	opts.ProgressSink <- AggregateTilesEvent{Done: true}
+	event := <-sink
+	assert.True(t, event.Done)
+}
+
+func TestAggregateTilesOptionsWithProgressRunStreamsEventsAndTotal(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	end := start.Add(3 * time.Hour)
+	sink := make(chan AggregateTilesEvent, 16)
+
+	opts, err := NewAggregateTilesOptionsWithProgressSink(start, end, time.Hour, false, sink)
+	require.NoError(t, err)
+
+	processed, err := opts.Run(context.Background(), []uint32{0, 1}, start, end, time.Hour,
+		func(_ context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error) {
+			return ShardBlockResult{SeriesProcessed: 10, SeriesWritten: 5}, nil
+		})
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), processed) // 2 shards x 3 tile windows
+
+	var events []AggregateTilesEvent
+	for i := 0; i < 6; i++ {
+		events = append(events, <-sink)
+	}
+	done := <-sink
+
+	assert.True(t, done.Done)
+	for _, event := range events {
+		assert.False(t, event.Done)
+		assert.Equal(t, int64(10), event.SeriesProcessed)
+		assert.Equal(t, int64(5), event.SeriesWritten)
+		assert.Equal(t, int64(0), event.Errors)
+	}
+}
+
+func TestAggregateTilesOptionsWithProgressRunRecordsPerBlockErrors(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	end := start.Add(2 * time.Hour)
+	sink := make(chan AggregateTilesEvent, 16)
+
+	opts, err := NewAggregateTilesOptionsWithProgressSink(start, end, time.Hour, false, sink)
+	require.NoError(t, err)
+
+	wantErr := errors.New("block processing failed")
+	processed, err := opts.Run(context.Background(), []uint32{0}, start, end, time.Hour,
+		func(_ context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error) {
+			if blockStart.Equal(start) {
+				return ShardBlockResult{}, wantErr
+			}
+			return ShardBlockResult{SeriesProcessed: 1, SeriesWritten: 1}, nil
+		})
+	require.Equal(t, wantErr, err)
+	assert.Equal(t, int64(2), processed)
+
+	first := <-sink
+	assert.Equal(t, int64(1), first.Errors)
+
+	second := <-sink
+	assert.Equal(t, int64(0), second.Errors)
+
+	done := <-sink
+	assert.True(t, done.Done)
+}
+
+func TestAggregateTilesOptionsWithProgressRunStopsOnCancellation(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	end := start.Add(3 * time.Hour)
+	sink := make(chan AggregateTilesEvent, 16)
+
+	opts, err := NewAggregateTilesOptionsWithProgressSink(start, end, time.Hour, false, sink)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	calls := 0
+	processed, err := opts.Run(ctx, []uint32{0}, start, end, time.Hour,
+		func(_ context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error) {
+			calls++
+			return ShardBlockResult{}, nil
+		})
+	require.Equal(t, context.Canceled, err)
+	assert.Equal(t, int64(0), processed)
+	assert.Equal(t, 0, calls, "Run must not start processing a pair once ctx is already cancelled")
+
+	done := <-sink
+	assert.True(t, done.Done)
+}
+
+func TestAggregateTilesOptionsWithProgressRunSendDoesNotDeadlockOnCancellation(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	end := start.Add(2 * time.Hour)
+	// Unbuffered: nothing drains it, so the second event's send would
+	// block forever without the ctx.Done() case in send.
+	sink := make(chan AggregateTilesEvent)
+
+	opts, err := NewAggregateTilesOptionsWithProgressSink(start, end, time.Hour, false, sink)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+
+	runDone := make(chan struct{})
+	go func() {
+		defer close(runDone)
+		opts.Run(ctx, []uint32{0}, start, end, time.Hour,
+			func(_ context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error) {
+				return ShardBlockResult{}, nil
+			})
+	}()
+
+	// Drain exactly one event, then cancel and stop draining - the
+	// scenario the doc comment calls out: a consumer that stops after
+	// cancelling ctx must not wedge Run.
+	<-sink
+	cancel()
+
+	select {
+	case <-runDone:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Run did not return after ctx was cancelled and the sink stopped draining")
+	}
+}
+
+func TestAggregateTilesOptionsWithProgressRunWithoutSink(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	end := start.Add(time.Hour)
+	base, err := NewAggregateTilesOptions(start, end, time.Hour, false)
+	require.NoError(t, err)
+
+	calls := 0
+	processed, err := base.WithProgressSink(nil).Run(context.Background(), []uint32{0}, start, end, time.Hour,
+		func(_ context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error) {
+			calls++
+			return ShardBlockResult{}, nil
+		})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), processed)
+	assert.Equal(t, 1, calls)
+}
@@ -0,0 +1,117 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// AggregateTilesWithRollupRulesOptions bundles the AggregateTilesOptions
+// AggregateTiles already takes with a RollupRuleSet to evaluate per tile
+// window. DB.AggregateTiles takes only AggregateTilesOptions and does not
+// read RollupRules; ShardBlockStep is what runs a caller's tile aggregation
+// step and, when RollupRules is non-empty, evaluates each rule (via the
+// in-process PromQL engine) against the reader it is given, handing the
+// resulting series, named after the rule's Record, to its appender.
+type AggregateTilesWithRollupRulesOptions struct {
+	AggregateTilesOptions
+
+	RollupRules RollupRuleSet
+}
+
+// NewAggregateTilesOptionsWithRollupRules builds an
+// AggregateTilesWithRollupRulesOptions from the same time-range/step
+// arguments as NewAggregateTilesOptions, plus the rollup rules to evaluate
+// per tile.
+func NewAggregateTilesOptionsWithRollupRules(
+	start, end time.Time,
+	step time.Duration,
+	insOptimizations bool,
+	rules RollupRuleSet,
+) (AggregateTilesWithRollupRulesOptions, error) {
+	if err := rules.Validate(); err != nil {
+		return AggregateTilesWithRollupRulesOptions{}, err
+	}
+
+	base, err := NewAggregateTilesOptions(start, end, step, insOptimizations)
+	if err != nil {
+		return AggregateTilesWithRollupRulesOptions{}, err
+	}
+
+	return AggregateTilesWithRollupRulesOptions{
+		AggregateTilesOptions: base,
+		RollupRules:           rules,
+	}, nil
+}
+
+// EvaluateTile runs opts.RollupRules against reader, the source tile's block
+// reader for the shard/block ending at tileEnd, appending each rule's
+// resulting series through appender. ShardBlockStep calls it after a
+// shard/block's own tile aggregation whenever opts.RollupRules is non-empty.
+// It returns the total number of rollup series written for this tile.
+func (opts AggregateTilesWithRollupRulesOptions) EvaluateTile(
+	ctx context.Context,
+	tileEnd time.Time,
+	reader RollupTileReader,
+	appender RollupResultAppender,
+) (int, error) {
+	return opts.RollupRules.Evaluate(ctx, tileEnd, reader, appender)
+}
+
+// ShardBlockStep runs aggregate - the caller's existing per-shard/block tile
+// aggregation for this source/target namespace pair - and, when
+// opts.RollupRules is non-empty, also evaluates those rules against the same
+// window via EvaluateTile, folding however many rollup series it wrote into
+// the returned ShardBlockResult's SeriesWritten. It returns a
+// ShardBlockResult, so a ShardBlockProcessor closure passed to
+// AggregateTilesOptionsWithProgress.Run can return its result directly: a
+// caller configured with both progress reporting and rollup rules calls
+// ShardBlockStep from that closure, binding tileEnd, aggregate, reader and
+// appender for each shard/block.
+//
+// ShardBlockStep only composes the pieces; it doesn't perform tile
+// aggregation itself.
+func (opts AggregateTilesWithRollupRulesOptions) ShardBlockStep(
+	ctx context.Context,
+	tileEnd time.Time,
+	aggregate func(ctx context.Context) (ShardBlockResult, error),
+	reader RollupTileReader,
+	appender RollupResultAppender,
+) (ShardBlockResult, error) {
+	result, err := aggregate(ctx)
+	if err != nil {
+		return result, err
+	}
+
+	if len(opts.RollupRules) == 0 {
+		return result, nil
+	}
+
+	written, err := opts.EvaluateTile(ctx, tileEnd, reader, appender)
+	if err != nil {
+		return result, fmt.Errorf("evaluate rollup rules for tile ending %s: %w", tileEnd, err)
+	}
+
+	result.SeriesWritten += int64(written)
+	return result, nil
+}
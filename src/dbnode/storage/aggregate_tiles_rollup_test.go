@@ -0,0 +1,150 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/model/labels"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewAggregateTilesOptionsWithRollupRules(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	rule, err := NewRollupRule("cpu:rate5m", "rate(cpu[5m])")
+	require.NoError(t, err)
+
+	opts, err := NewAggregateTilesOptionsWithRollupRules(
+		start, start.Add(6*time.Hour), time.Hour, false, RollupRuleSet{rule})
+	require.NoError(t, err)
+	assert.Equal(t, RollupRuleSet{rule}, opts.RollupRules)
+}
+
+func TestNewAggregateTilesOptionsWithRollupRulesRejectsInvalidRuleSet(t *testing.T) {
+	start := time.Now().Truncate(time.Hour)
+	a, err := NewRollupRule("cpu:rate5m", "rate(cpu[5m])")
+	require.NoError(t, err)
+	b, err := NewRollupRule("cpu:rate5m", "avg(cpu)")
+	require.NoError(t, err)
+
+	_, err = NewAggregateTilesOptionsWithRollupRules(
+		start, start.Add(6*time.Hour), time.Hour, false, RollupRuleSet{a, b})
+	require.Error(t, err)
+}
+
+func TestShardBlockStepFoldsRollupSeriesIntoSeriesWritten(t *testing.T) {
+	rule, err := NewRollupRule("cpu:copy", "cpu")
+	require.NoError(t, err)
+
+	opts, err := NewAggregateTilesOptionsWithRollupRules(
+		time.Now().Truncate(time.Hour), time.Now().Add(time.Hour), time.Hour, false, RollupRuleSet{rule})
+	require.NoError(t, err)
+
+	tileEnd := time.Unix(1700000000, 0)
+	reader := &fakeTileReader{series: []*fakeTileSeries{
+		{metric: labels.FromStrings("__name__", "cpu", "job", "job1"), t: tileEnd.UnixMilli(), v: 1},
+	}}
+	appender := &fakeRollupAppender{}
+
+	result, err := opts.ShardBlockStep(context.Background(), tileEnd,
+		func(context.Context) (ShardBlockResult, error) {
+			return ShardBlockResult{SeriesProcessed: 10, SeriesWritten: 10}, nil
+		}, reader, appender)
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), result.SeriesProcessed)
+	assert.Equal(t, int64(11), result.SeriesWritten) // 10 aggregated + 1 rollup series
+	assert.Len(t, appender.appended, 1)
+}
+
+func TestShardBlockStepSkipsRollupEvaluationWhenRuleSetEmpty(t *testing.T) {
+	opts, err := NewAggregateTilesOptionsWithRollupRules(
+		time.Now().Truncate(time.Hour), time.Now().Add(time.Hour), time.Hour, false, nil)
+	require.NoError(t, err)
+
+	result, err := opts.ShardBlockStep(context.Background(), time.Unix(1700000000, 0),
+		func(context.Context) (ShardBlockResult, error) {
+			return ShardBlockResult{SeriesProcessed: 5, SeriesWritten: 5}, nil
+		}, &fakeTileReader{}, &fakeRollupAppender{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), result.SeriesWritten)
+}
+
+func TestShardBlockStepReturnsAggregateErrorWithoutEvaluatingRollupRules(t *testing.T) {
+	rule, err := NewRollupRule("cpu:copy", "cpu")
+	require.NoError(t, err)
+
+	opts, err := NewAggregateTilesOptionsWithRollupRules(
+		time.Now().Truncate(time.Hour), time.Now().Add(time.Hour), time.Hour, false, RollupRuleSet{rule})
+	require.NoError(t, err)
+
+	wantErr := errors.New("aggregation failed")
+	appender := &fakeRollupAppender{}
+	_, err = opts.ShardBlockStep(context.Background(), time.Unix(1700000000, 0),
+		func(context.Context) (ShardBlockResult, error) {
+			return ShardBlockResult{}, wantErr
+		}, &fakeTileReader{}, appender)
+	require.Equal(t, wantErr, err)
+	assert.Empty(t, appender.appended)
+}
+
+// TestShardBlockStepComposesWithProgressRun demonstrates the intended
+// integration: ShardBlockStep bound to a per-shard/block aggregate closure
+// passed directly as Run's ShardBlockProcessor, so progress events report
+// each block's combined aggregated+rollup SeriesWritten total.
+func TestShardBlockStepComposesWithProgressRun(t *testing.T) {
+	rule, err := NewRollupRule("cpu:copy", "cpu")
+	require.NoError(t, err)
+
+	start := time.Unix(1700000000, 0)
+	end := start.Add(time.Hour)
+	sink := make(chan AggregateTilesEvent, 4)
+
+	opts, err := NewAggregateTilesOptionsWithRollupRules(start, end, time.Hour, false, RollupRuleSet{rule})
+	require.NoError(t, err)
+	progress, err := NewAggregateTilesOptionsWithProgressSink(start, end, time.Hour, false, sink)
+	require.NoError(t, err)
+
+	appender := &fakeRollupAppender{}
+	reader := &fakeTileReader{series: []*fakeTileSeries{
+		{metric: labels.FromStrings("__name__", "cpu", "job", "job1"), t: start.UnixMilli(), v: 1},
+	}}
+
+	processed, err := progress.Run(context.Background(), []uint32{0}, start, end, time.Hour,
+		func(ctx context.Context, shard uint32, blockStart time.Time) (ShardBlockResult, error) {
+			return opts.ShardBlockStep(ctx, blockStart,
+				func(context.Context) (ShardBlockResult, error) {
+					return ShardBlockResult{SeriesProcessed: 1, SeriesWritten: 1}, nil
+				}, reader, appender)
+		})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), processed)
+
+	event := <-sink
+	assert.Equal(t, int64(2), event.SeriesWritten) // 1 aggregated + 1 rollup series
+
+	done := <-sink
+	assert.True(t, done.Done)
+}
@@ -0,0 +1,279 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/m3db/m3/src/x/ident"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/prometheus/prometheus/promql/parser"
+	promstorage "github.com/prometheus/prometheus/storage"
+)
+
+// rollupEvaluatorMaxSamples, rollupEvaluatorTimeout, and
+// rollupEvaluatorLookbackDelta configure the one-off PromQL engine
+// RollupRuleSet.Evaluate builds for each call, rather than a long-lived
+// engine like the query path's per-tenant ones (see
+// src/query/api/v1/handler/prom's EnginePool). A single tile's worth of data
+// is small relative to a user query, so the sample and timeout bounds are
+// tighter than that package's DefaultEngineLimits; the lookback delta is the
+// same 5m.
+const (
+	rollupEvaluatorMaxSamples    = 1000000
+	rollupEvaluatorTimeout       = 30 * time.Second
+	rollupEvaluatorLookbackDelta = 5 * time.Minute
+)
+
+// rollupAllowedAggregators are the aggregation operators NewRollupRule
+// accepts as a rule's outermost node, with or without by/without grouping,
+// e.g. "sum(rate(cpu[5m])) by (job)". Rules don't have to use one of these
+// at all - "rate(cpu[5m])" is a valid rule on its own. Only the outermost
+// node is checked; aggregations nested deeper in the expression are not.
+var rollupAllowedAggregators = map[string]struct{}{
+	"sum":      {},
+	"avg":      {},
+	"min":      {},
+	"max":      {},
+	"count":    {},
+	"quantile": {},
+}
+
+// RollupRule is a single recording-rule-style PromQL rollup:
+// RollupRuleSet.Evaluate runs Expr as an instant query over a RollupTileReader and hands
+// each resulting series, renamed to Record and keeping the labels the
+// expression leaves, to a RollupResultAppender. DB.AggregateTiles takes only
+// AggregateTilesOptions and does not evaluate rollup rules itself.
+type RollupRule struct {
+	// Record is the output series name written to the target namespace.
+	Record string
+	// Expr is the recording-rule expression, e.g. "rate(cpu[5m])".
+	Expr string
+
+	expr parser.Expr
+}
+
+// NewRollupRule parses and validates expr, returning a RollupRule ready to
+// be evaluated by RollupRuleSet.Evaluate. expr must produce an instant
+// vector (one datapoint per output series at the tile's end); if its
+// outermost node is an aggregation, that aggregation must be one of
+// rollupAllowedAggregators.
+func NewRollupRule(record, expr string) (RollupRule, error) {
+	if record == "" {
+		return RollupRule{}, fmt.Errorf("rollup rule record name must not be empty")
+	}
+
+	parsed, err := parser.ParseExpr(expr)
+	if err != nil {
+		return RollupRule{}, fmt.Errorf("parse rollup rule %q expr: %w", record, err)
+	}
+
+	if parsed.Type() != parser.ValueTypeVector {
+		return RollupRule{}, fmt.Errorf(
+			"rollup rule %q: expr must evaluate to an instant vector, got %s", record, parsed.Type())
+	}
+
+	if agg, ok := parsed.(*parser.AggregateExpr); ok {
+		if _, ok := rollupAllowedAggregators[agg.Op.String()]; !ok {
+			return RollupRule{}, fmt.Errorf(
+				"rollup rule %q: unsupported aggregation %q, must be one of %s",
+				record, agg.Op.String(), allowedAggregatorNames())
+		}
+	}
+
+	return RollupRule{Record: record, Expr: expr, expr: parsed}, nil
+}
+
+func allowedAggregatorNames() string {
+	names := make([]string, 0, len(rollupAllowedAggregators))
+	for name := range rollupAllowedAggregators {
+		names = append(names, name)
+	}
+
+	return fmt.Sprint(names)
+}
+
+// RollupRuleSet is a set of rollup rules evaluated together for a single
+// source->target namespace pair, once per tile window.
+type RollupRuleSet []RollupRule
+
+// Validate returns an error if any two rules in the set write to the same
+// Record, since one rule's output would otherwise silently overwrite
+// another's within the same tile.
+func (rs RollupRuleSet) Validate() error {
+	seen := make(map[string]struct{}, len(rs))
+	for _, rule := range rs {
+		if _, ok := seen[rule.Record]; ok {
+			return fmt.Errorf("duplicate rollup rule record name %q", rule.Record)
+		}
+
+		seen[rule.Record] = struct{}{}
+	}
+
+	return nil
+}
+
+// RollupTileReader gives a RollupRule's PromQL evaluation read access to a
+// single source tile: the one slice of data the rule is evaluated against.
+// The caller of RollupRuleSet.Evaluate supplies the implementation; this
+// package provides none backed by a block reader.
+type RollupTileReader interface {
+	// Select returns the tile's series matching matchers, for the evaluator
+	// to feed into the PromQL engine as its instant-query input.
+	Select(matchers ...*labels.Matcher) (promstorage.SeriesSet, error)
+}
+
+// RollupResultAppender receives the series a RollupRule evaluation
+// produces; the caller's implementation decides where they are written.
+type RollupResultAppender interface {
+	Append(tags ident.Tags, timestamp time.Time, value float64) error
+}
+
+// Evaluate runs every rule in rs against reader via an instant PromQL query
+// pinned at tileEnd, appending each rule's resulting series (relabeled with
+// __name__ set to the rule's Record) through appender. It returns the total
+// number of series written across all rules.
+func (rs RollupRuleSet) Evaluate(
+	ctx context.Context,
+	tileEnd time.Time,
+	reader RollupTileReader,
+	appender RollupResultAppender,
+) (int, error) {
+	if len(rs) == 0 {
+		return 0, nil
+	}
+
+	engine := promql.NewEngine(promql.EngineOpts{
+		MaxSamples:    rollupEvaluatorMaxSamples,
+		Timeout:       rollupEvaluatorTimeout,
+		LookbackDelta: rollupEvaluatorLookbackDelta,
+	})
+	queryable := rollupTileQueryable{reader: reader}
+
+	written := 0
+	for _, rule := range rs {
+		n, err := rule.evaluate(ctx, engine, queryable, tileEnd, appender)
+		if err != nil {
+			return written, fmt.Errorf("evaluate rollup rule %q: %w", rule.Record, err)
+		}
+
+		written += n
+	}
+
+	return written, nil
+}
+
+// evaluate runs r's expr as an instant query at tileEnd and appends every
+// resulting sample, under r.Record, through appender.
+func (r RollupRule) evaluate(
+	ctx context.Context,
+	engine *promql.Engine,
+	queryable promstorage.Queryable,
+	tileEnd time.Time,
+	appender RollupResultAppender,
+) (int, error) {
+	query, err := engine.NewInstantQuery(queryable, r.Expr, tileEnd)
+	if err != nil {
+		return 0, err
+	}
+	defer query.Close()
+
+	res := query.Exec(ctx)
+	if res.Err != nil {
+		return 0, res.Err
+	}
+
+	vector, err := res.Vector()
+	if err != nil {
+		return 0, err
+	}
+
+	written := 0
+	for _, sample := range vector {
+		if err := appender.Append(rollupRecordTags(r.Record, sample.Metric), tileEnd, sample.V); err != nil {
+			return written, err
+		}
+
+		written++
+	}
+
+	return written, nil
+}
+
+// rollupRecordTags relabels metric to record (dropping metric's own
+// __name__, if any) and converts the result to ident.Tags, the tag
+// representation RollupResultAppender.Append takes.
+func rollupRecordTags(record string, metric labels.Labels) ident.Tags {
+	tags := make([]ident.Tag, 0, len(metric))
+	for _, lbl := range metric {
+		if lbl.Name == labels.MetricName {
+			continue
+		}
+
+		tags = append(tags, ident.StringTag(lbl.Name, lbl.Value))
+	}
+
+	tags = append(tags, ident.StringTag(labels.MetricName, record))
+
+	return ident.NewTags(tags...)
+}
+
+// rollupTileQueryable adapts a RollupTileReader to the promql engine's
+// storage.Queryable interface so RollupRuleSet.Evaluate can hand it directly
+// to promql.Engine.NewInstantQuery.
+type rollupTileQueryable struct {
+	reader RollupTileReader
+}
+
+func (q rollupTileQueryable) Querier(_, _ int64) (promstorage.Querier, error) {
+	return rollupTileQuerier{reader: q.reader}, nil
+}
+
+type rollupTileQuerier struct {
+	reader RollupTileReader
+}
+
+func (q rollupTileQuerier) Select(
+	_ bool,
+	_ *promstorage.SelectHints,
+	matchers ...*labels.Matcher,
+) promstorage.SeriesSet {
+	set, err := q.reader.Select(matchers...)
+	if err != nil {
+		return promstorage.ErrSeriesSet(err)
+	}
+
+	return set
+}
+
+func (q rollupTileQuerier) LabelValues(string, ...*labels.Matcher) ([]string, promstorage.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (q rollupTileQuerier) LabelNames(...*labels.Matcher) ([]string, promstorage.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (q rollupTileQuerier) Close() error { return nil }
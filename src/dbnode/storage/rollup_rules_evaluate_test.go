@@ -0,0 +1,144 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/x/ident"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	promstorage "github.com/prometheus/prometheus/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTileSeries is a single-sample in-memory series, enough for Evaluate's
+// instant queries against a bare vector selector or an aggregation over one.
+type fakeTileSeries struct {
+	metric labels.Labels
+	t      int64
+	v      float64
+	read   bool
+}
+
+func (s *fakeTileSeries) Labels() labels.Labels       { return s.metric }
+func (s *fakeTileSeries) Iterator() chunkenc.Iterator { return s }
+func (s *fakeTileSeries) Seek(t int64) bool {
+	if s.read || t > s.t {
+		return false
+	}
+	s.read = true
+	return true
+}
+func (s *fakeTileSeries) At() (int64, float64) { return s.t, s.v }
+func (s *fakeTileSeries) Next() bool {
+	if s.read {
+		return false
+	}
+	s.read = true
+	return true
+}
+func (s *fakeTileSeries) Err() error { return nil }
+
+type fakeTileSeriesSet struct {
+	series []*fakeTileSeries
+	idx    int
+}
+
+func (s *fakeTileSeriesSet) Next() bool {
+	s.idx++
+	return s.idx <= len(s.series)
+}
+func (s *fakeTileSeriesSet) At() promstorage.Series         { return s.series[s.idx-1] }
+func (s *fakeTileSeriesSet) Err() error                     { return nil }
+func (s *fakeTileSeriesSet) Warnings() promstorage.Warnings { return nil }
+
+// fakeTileReader is a RollupTileReader backed by a fixed set of series,
+// ignoring matchers (the tests below only ever select one metric name).
+type fakeTileReader struct {
+	series []*fakeTileSeries
+}
+
+func (r *fakeTileReader) Select(_ ...*labels.Matcher) (promstorage.SeriesSet, error) {
+	return &fakeTileSeriesSet{series: r.series}, nil
+}
+
+type recordedRollupSeries struct {
+	tags      ident.Tags
+	timestamp time.Time
+	value     float64
+}
+
+type fakeRollupAppender struct {
+	appended []recordedRollupSeries
+}
+
+func (a *fakeRollupAppender) Append(tags ident.Tags, timestamp time.Time, value float64) error {
+	a.appended = append(a.appended, recordedRollupSeries{tags: tags, timestamp: timestamp, value: value})
+	return nil
+}
+
+func TestRollupRuleSetEvaluateBareVectorSelector(t *testing.T) {
+	rule, err := NewRollupRule("cpu:copy", "cpu")
+	require.NoError(t, err)
+
+	tileEnd := time.Unix(1700000000, 0)
+	reader := &fakeTileReader{series: []*fakeTileSeries{
+		{metric: labels.FromStrings("__name__", "cpu", "job", "job1"), t: tileEnd.UnixMilli(), v: 42},
+	}}
+	appender := &fakeRollupAppender{}
+
+	written, err := RollupRuleSet{rule}.Evaluate(context.Background(), tileEnd, reader, appender)
+	require.NoError(t, err)
+	require.Equal(t, 1, written)
+	require.Len(t, appender.appended, 1)
+	require.Equal(t, 42.0, appender.appended[0].value)
+
+	gotName, ok := findTag(appender.appended[0].tags, "__name__")
+	require.True(t, ok)
+	assert.Equal(t, "cpu:copy", gotName)
+
+	gotJob, ok := findTag(appender.appended[0].tags, "job")
+	require.True(t, ok)
+	assert.Equal(t, "job1", gotJob)
+}
+
+func findTag(tags ident.Tags, name string) (value string, ok bool) {
+	for _, tag := range tags.Values() {
+		if tag.Name.String() == name {
+			return tag.Value.String(), true
+		}
+	}
+
+	return "", false
+}
+
+func TestRollupRuleSetEvaluateEmptyRuleSetIsNoop(t *testing.T) {
+	tileEnd := time.Unix(1700000000, 0)
+	written, err := RollupRuleSet(nil).Evaluate(context.Background(), tileEnd, &fakeTileReader{}, &fakeRollupAppender{})
+	require.NoError(t, err)
+	require.Equal(t, 0, written)
+}
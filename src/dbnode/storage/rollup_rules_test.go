@@ -0,0 +1,78 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package storage
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRollupRule(t *testing.T) {
+	rule, err := NewRollupRule("cpu:rate5m", "rate(cpu[5m])")
+	require.NoError(t, err)
+	assert.Equal(t, "cpu:rate5m", rule.Record)
+
+	rule, err = NewRollupRule("cpu:sum:rate5m", "sum(rate(cpu[5m])) by (job)")
+	require.NoError(t, err)
+	assert.Equal(t, "cpu:sum:rate5m", rule.Record)
+}
+
+func TestNewRollupRuleRejectsEmptyRecord(t *testing.T) {
+	_, err := NewRollupRule("", "rate(cpu[5m])")
+	require.Error(t, err)
+}
+
+func TestNewRollupRuleRejectsUnsupportedAggregation(t *testing.T) {
+	_, err := NewRollupRule("cpu:topk", "topk(5, cpu)")
+	require.Error(t, err)
+}
+
+func TestNewRollupRuleRejectsRangeVectorExpr(t *testing.T) {
+	_, err := NewRollupRule("cpu:raw", "cpu[5m]")
+	require.Error(t, err)
+}
+
+func TestNewRollupRuleAllowsBareVectorSelector(t *testing.T) {
+	rule, err := NewRollupRule("cpu:raw", "cpu")
+	require.NoError(t, err)
+	assert.Equal(t, "cpu:raw", rule.Record)
+}
+
+func TestRollupRuleSetValidateDuplicateRecord(t *testing.T) {
+	a, err := NewRollupRule("cpu:rate5m", "rate(cpu[5m])")
+	require.NoError(t, err)
+	b, err := NewRollupRule("cpu:rate5m", "avg(cpu)")
+	require.NoError(t, err)
+
+	err = RollupRuleSet{a, b}.Validate()
+	require.Error(t, err)
+}
+
+func TestRollupRuleSetValidateOK(t *testing.T) {
+	a, err := NewRollupRule("cpu:rate5m", "rate(cpu[5m])")
+	require.NoError(t, err)
+	b, err := NewRollupRule("cpu:avg", "avg(cpu)")
+	require.NoError(t, err)
+
+	require.NoError(t, RollupRuleSet{a, b}.Validate())
+}
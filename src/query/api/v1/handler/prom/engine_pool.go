@@ -0,0 +1,222 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"container/list"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/m3db/m3/src/x/instrument"
+
+	kitlog "github.com/go-kit/log"
+	"github.com/prometheus/prometheus/promql"
+	"github.com/uber-go/tally"
+)
+
+// Tenant headers checked, in order, to resolve the engine a request should
+// use when Options.EnginePool is configured and no TenantResolver is set.
+const (
+	tenantHeaderM3         = "M3-Tenant"
+	tenantHeaderScopeOrgID = "X-Scope-OrgID"
+	defaultTenant          = "default"
+)
+
+// EngineLimits are the per-tenant resource bounds a TenantEngineConfigSource
+// supplies for a tenant's PromQL engine.
+type EngineLimits struct {
+	MaxSamples           int
+	MaxConcurrent        int
+	LookbackDelta        time.Duration
+	Timeout              time.Duration
+	EnableAtModifier     bool
+	EnableNegativeOffset bool
+}
+
+// TenantEngineConfigSource resolves the EngineLimits a tenant's engine
+// should be built with. Implementations typically read from the dynamic
+// config system (e.g. per-namespace overrides); DefaultEngineLimits is used
+// when no source is configured.
+type TenantEngineConfigSource interface {
+	EngineLimitsForTenant(tenant string) EngineLimits
+}
+
+// DefaultEngineLimits mirrors the defaults the single shared engine used
+// before per-tenant pooling was introduced.
+var DefaultEngineLimits = EngineLimits{
+	MaxSamples:           50000000,
+	MaxConcurrent:        20,
+	LookbackDelta:        5 * time.Minute,
+	Timeout:              2 * time.Minute,
+	EnableAtModifier:     true,
+	EnableNegativeOffset: true,
+}
+
+// EnginePool lazily constructs and caches one *promql.Engine per tenant,
+// evicting the least recently used engine once the pool grows past maxIdle.
+// This gives multi-tenant deployments resource isolation (max samples,
+// concurrency, timeout) that a single global engine cannot provide.
+type EnginePool struct {
+	mu          sync.Mutex
+	lru         *list.List
+	items       map[string]*list.Element
+	maxIdle     int
+	config      TenantEngineConfigSource
+	queryLogDir string
+
+	created tally.Counter
+	evicted tally.Counter
+	size    tally.Gauge
+}
+
+type enginePoolEntry struct {
+	tenant  string
+	engine  *promql.Engine
+	tracker promql.QueryTracker
+}
+
+// NewEnginePool creates a pool that evicts down to maxIdle idle engines and
+// reports creation/eviction metrics under instrumentOpts' scope. config may
+// be nil, in which case every tenant gets DefaultEngineLimits. queryLogDir is
+// the base directory each tenant's promql.ActiveQueryTracker (used to
+// enforce EngineLimits.MaxConcurrent) persists its concurrent-query log
+// under, one subdirectory per tenant.
+func NewEnginePool(
+	maxIdle int,
+	config TenantEngineConfigSource,
+	queryLogDir string,
+	instrumentOpts instrument.Options,
+) *EnginePool {
+	scope := instrumentOpts.MetricsScope().SubScope("promql_engine_pool")
+	return &EnginePool{
+		lru:         list.New(),
+		items:       make(map[string]*list.Element),
+		maxIdle:     maxIdle,
+		config:      config,
+		queryLogDir: queryLogDir,
+		created:     scope.Counter("created"),
+		evicted:     scope.Counter("evicted"),
+		size:        scope.Gauge("size"),
+	}
+}
+
+// Engine returns the cached engine for tenant, lazily building one (and
+// evicting the least recently used entry if the pool is full) if needed.
+func (p *EnginePool) Engine(tenant string) *promql.Engine {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if el, ok := p.items[tenant]; ok {
+		p.lru.MoveToFront(el)
+		return el.Value.(*enginePoolEntry).engine
+	}
+
+	limits := p.limitsForTenant(tenant)
+	tracker := p.newTrackerForTenant(tenant, limits)
+	engine := promql.NewEngine(engineOptsFromLimits(limits, tracker))
+	el := p.lru.PushFront(&enginePoolEntry{tenant: tenant, engine: engine, tracker: tracker})
+	p.items[tenant] = el
+	p.created.Inc(1)
+	p.size.Update(float64(len(p.items)))
+
+	p.evictLocked()
+
+	return engine
+}
+
+func (p *EnginePool) limitsForTenant(tenant string) EngineLimits {
+	if p.config == nil {
+		return DefaultEngineLimits
+	}
+
+	return p.config.EngineLimitsForTenant(tenant)
+}
+
+// newTrackerForTenant builds the promql.ActiveQueryTracker that enforces
+// limits.MaxConcurrent for tenant, or returns nil if MaxConcurrent is
+// unbounded (<= 0).
+func (p *EnginePool) newTrackerForTenant(tenant string, limits EngineLimits) promql.QueryTracker {
+	if limits.MaxConcurrent <= 0 {
+		return nil
+	}
+
+	dir := filepath.Join(p.queryLogDir, tenant)
+	_ = os.MkdirAll(dir, 0o755)
+
+	return promql.NewActiveQueryTracker(dir, limits.MaxConcurrent, kitlog.NewNopLogger())
+}
+
+// evictLocked removes least-recently-used entries until the pool is back
+// within maxIdle. Callers must hold p.mu.
+func (p *EnginePool) evictLocked() {
+	for len(p.items) > p.maxIdle {
+		oldest := p.lru.Back()
+		if oldest == nil {
+			return
+		}
+
+		entry := oldest.Value.(*enginePoolEntry)
+		p.lru.Remove(oldest)
+		delete(p.items, entry.tenant)
+		p.evicted.Inc(1)
+
+		if entry.tracker != nil {
+			_ = entry.tracker.Close()
+		}
+	}
+
+	p.size.Update(float64(len(p.items)))
+}
+
+func engineOptsFromLimits(limits EngineLimits, tracker promql.QueryTracker) promql.EngineOpts {
+	return promql.EngineOpts{
+		MaxSamples:           limits.MaxSamples,
+		Timeout:              limits.Timeout,
+		LookbackDelta:        limits.LookbackDelta,
+		EnableAtModifier:     limits.EnableAtModifier,
+		EnableNegativeOffset: limits.EnableNegativeOffset,
+		ActiveQueryTracker:   tracker,
+	}
+}
+
+// resolveTenant extracts the tenant a request should be evaluated under,
+// preferring opts.TenantResolver when set, then the M3-Tenant header, then
+// X-Scope-OrgID, falling back to defaultTenant.
+func resolveTenant(r *http.Request, opts Options) string {
+	if opts.TenantResolver != nil {
+		if tenant := opts.TenantResolver(r); tenant != "" {
+			return tenant
+		}
+	}
+
+	if tenant := r.Header.Get(tenantHeaderM3); tenant != "" {
+		return tenant
+	}
+
+	if tenant := r.Header.Get(tenantHeaderScopeOrgID); tenant != "" {
+		return tenant
+	}
+
+	return defaultTenant
+}
@@ -0,0 +1,110 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/m3db/m3/src/x/instrument"
+
+	"github.com/stretchr/testify/require"
+)
+
+type fakeTenantEngineConfigSource struct {
+	limits map[string]EngineLimits
+}
+
+func (f fakeTenantEngineConfigSource) EngineLimitsForTenant(tenant string) EngineLimits {
+	if limits, ok := f.limits[tenant]; ok {
+		return limits
+	}
+
+	return DefaultEngineLimits
+}
+
+func TestEnginePoolEngineIsCachedPerTenant(t *testing.T) {
+	pool := NewEnginePool(2, nil, t.TempDir(), instrument.NewOptions())
+
+	a1 := pool.Engine("tenant-a")
+	a2 := pool.Engine("tenant-a")
+	b1 := pool.Engine("tenant-b")
+
+	require.Same(t, a1, a2)
+	require.NotSame(t, a1, b1)
+}
+
+func TestEnginePoolEvictsLeastRecentlyUsed(t *testing.T) {
+	pool := NewEnginePool(1, nil, t.TempDir(), instrument.NewOptions())
+
+	first := pool.Engine("tenant-a")
+	pool.Engine("tenant-b") // evicts tenant-a, since maxIdle is 1
+
+	require.Len(t, pool.items, 1)
+	require.NotContains(t, pool.items, "tenant-a")
+
+	rebuilt := pool.Engine("tenant-a")
+	require.NotSame(t, first, rebuilt)
+}
+
+func TestEnginePoolHonorsPerTenantMaxConcurrent(t *testing.T) {
+	config := fakeTenantEngineConfigSource{limits: map[string]EngineLimits{
+		"tenant-a": {MaxSamples: 1000, MaxConcurrent: 1, LookbackDelta: DefaultEngineLimits.LookbackDelta, Timeout: DefaultEngineLimits.Timeout},
+	}}
+	pool := NewEnginePool(2, config, t.TempDir(), instrument.NewOptions())
+	require.Empty(t, pool.items)
+
+	pool.Engine("tenant-a")
+	entry := pool.items["tenant-a"].Value.(*enginePoolEntry)
+	require.NotNil(t, entry.tracker)
+}
+
+func TestEnginePoolUnboundedConcurrencyHasNoTracker(t *testing.T) {
+	config := fakeTenantEngineConfigSource{limits: map[string]EngineLimits{
+		"tenant-a": {MaxSamples: 1000, MaxConcurrent: 0, LookbackDelta: DefaultEngineLimits.LookbackDelta, Timeout: DefaultEngineLimits.Timeout},
+	}}
+	pool := NewEnginePool(2, config, t.TempDir(), instrument.NewOptions())
+
+	pool.Engine("tenant-a")
+	entry := pool.items["tenant-a"].Value.(*enginePoolEntry)
+	require.Nil(t, entry.tracker)
+}
+
+func TestResolveTenantPrecedence(t *testing.T) {
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set(tenantHeaderM3, "from-m3-header")
+	r.Header.Set(tenantHeaderScopeOrgID, "from-scope-header")
+
+	require.Equal(t, "from-m3-header", resolveTenant(r, Options{}))
+
+	r2 := httptest.NewRequest("GET", "/", nil)
+	r2.Header.Set(tenantHeaderScopeOrgID, "from-scope-header")
+	require.Equal(t, "from-scope-header", resolveTenant(r2, Options{}))
+
+	r3 := httptest.NewRequest("GET", "/", nil)
+	require.Equal(t, defaultTenant, resolveTenant(r3, Options{}))
+
+	r4 := httptest.NewRequest("GET", "/", nil)
+	r4.Header.Set(tenantHeaderM3, "ignored")
+	resolverOpts := Options{}.WithTenantResolver(func(req *http.Request) string { return "from-resolver" })
+	require.Equal(t, "from-resolver", resolveTenant(r4, resolverOpts))
+}
@@ -0,0 +1,171 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// requestIDHeader and traceparentHeader are the headers NewReadHandlerWithHooks
+// checks, in order, to find a correlation ID to propagate rather than mint a
+// new one. traceparentHeader follows the W3C Trace Context format
+// ("version-traceid-spanid-flags"); only the trace ID segment is used.
+const (
+	requestIDHeader   = "X-Request-ID"
+	traceparentHeader = "traceparent"
+)
+
+type queryLoggerContextKey struct{}
+
+// QueryLogger wraps a *slog.Logger with Info/Warn/Error/Debug sugar methods.
+// Loggers scoped via WithRequestID carry that request's correlation ID on
+// every line. In this package, ApplyRangeWarningsWithContext and the remote
+// write 2.0 exemplar warning log through it; the read handler's parsing,
+// planning, fetch and evaluation logging does not.
+type QueryLogger struct {
+	logger *slog.Logger
+}
+
+// NewQueryLogger wraps base so it can be attached to Options and, per
+// request, scoped to a correlation ID via WithRequestID. base's handler is
+// wrapped with a dedupingHandler so that every logger derived from it
+// (including per-request loggers produced by WithRequestID) collapses
+// repeated identical warnings within a single query.
+func NewQueryLogger(base *slog.Logger) *QueryLogger {
+	return &QueryLogger{logger: slog.New(NewDedupingHandler(base.Handler()))}
+}
+
+// WithRequestID returns a QueryLogger that attaches requestID to every log
+// line it emits.
+func (l *QueryLogger) WithRequestID(requestID string) *QueryLogger {
+	return &QueryLogger{logger: l.logger.With(slog.String("request_id", requestID))}
+}
+
+// Info logs msg at info level with the given key-value attrs.
+func (l *QueryLogger) Info(msg string, args ...any) { l.logger.Info(msg, args...) }
+
+// Warn logs msg at warn level with the given key-value attrs.
+func (l *QueryLogger) Warn(msg string, args ...any) { l.logger.Warn(msg, args...) }
+
+// Error logs msg at error level with the given key-value attrs.
+func (l *QueryLogger) Error(msg string, args ...any) { l.logger.Error(msg, args...) }
+
+// Debug logs msg at debug level with the given key-value attrs.
+func (l *QueryLogger) Debug(msg string, args ...any) { l.logger.Debug(msg, args...) }
+
+// queryLoggerFromContext returns the QueryLogger attached to ctx by
+// withCorrelatedQueryLogger, or a no-op discard logger if none was attached
+// (e.g. in tests that call package functions directly).
+func queryLoggerFromContext(ctx context.Context) *QueryLogger {
+	if l, ok := ctx.Value(queryLoggerContextKey{}).(*QueryLogger); ok {
+		return l
+	}
+
+	return NewQueryLogger(slog.New(slog.NewTextHandler(io.Discard, nil)))
+}
+
+// withCorrelatedQueryLogger resolves the request's correlation ID (from
+// X-Request-ID, falling back to the trace ID segment of traceparent, falling
+// back to a newly minted UUID) and returns a context carrying a QueryLogger
+// scoped to it, along with the ID itself.
+func withCorrelatedQueryLogger(r *http.Request, base *QueryLogger) (context.Context, string) {
+	id := r.Header.Get(requestIDHeader)
+	if id == "" {
+		id = traceIDFromTraceparent(r.Header.Get(traceparentHeader))
+	}
+	if id == "" {
+		id = uuid.NewString()
+	}
+
+	scoped := base.WithRequestID(id)
+	return context.WithValue(r.Context(), queryLoggerContextKey{}, scoped), id
+}
+
+// traceIDFromTraceparent extracts the trace ID segment from a W3C Trace
+// Context "traceparent" header value ("version-traceid-spanid-flags"),
+// returning "" if it is malformed.
+func traceIDFromTraceparent(header string) string {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) == 0 {
+		return ""
+	}
+
+	return parts[1]
+}
+
+// dedupingHandler wraps a slog.Handler and suppresses repeated records
+// (matched by level+message+attrs) so that a warning emitted once per series
+// in a fan-out fetch does not flood the log for a single query.
+type dedupingHandler struct {
+	slog.Handler
+
+	mu   sync.Mutex
+	seen map[string]struct{}
+}
+
+// NewDedupingHandler wraps next so that identical records are only emitted
+// once per logger instance; callers typically create one per request (e.g.
+// via WithRequestID-scoped loggers) so dedup is scoped to a single query.
+func NewDedupingHandler(next slog.Handler) slog.Handler {
+	return &dedupingHandler{Handler: next, seen: make(map[string]struct{})}
+}
+
+func (h *dedupingHandler) Handle(ctx context.Context, record slog.Record) error {
+	key := record.Level.String() + "|" + record.Message
+	record.Attrs(func(a slog.Attr) bool {
+		key += "|" + a.String()
+		return true
+	})
+
+	h.mu.Lock()
+	_, duplicate := h.seen[key]
+	if !duplicate {
+		h.seen[key] = struct{}{}
+	}
+	h.mu.Unlock()
+
+	if duplicate {
+		return nil
+	}
+
+	return h.Handler.Handle(ctx, record)
+}
+
+// WithAttrs re-wraps the inner handler's WithAttrs result in a fresh
+// dedupingHandler so that loggers derived via slog.Logger.With (e.g.
+// QueryLogger.WithRequestID) keep deduping instead of falling through to
+// the unwrapped inner handler.
+func (h *dedupingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return NewDedupingHandler(h.Handler.WithAttrs(attrs))
+}
+
+// WithGroup re-wraps the inner handler's WithGroup result in a fresh
+// dedupingHandler for the same reason as WithAttrs.
+func (h *dedupingHandler) WithGroup(name string) slog.Handler {
+	return NewDedupingHandler(h.Handler.WithGroup(name))
+}
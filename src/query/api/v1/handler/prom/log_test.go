@@ -0,0 +1,57 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"bytes"
+	"log/slog"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestQueryLoggerWithRequestIDDedupes(t *testing.T) {
+	var buf bytes.Buffer
+	base := NewQueryLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	// WithRequestID goes through slog.Logger.With, which calls
+	// Handler.WithAttrs under the hood; the scoped logger must still dedup.
+	scoped := base.WithRequestID("req-1")
+	scoped.Warn("subquery range exceeds retention")
+	scoped.Warn("subquery range exceeds retention")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 1)
+	require.Contains(t, lines[0], "req-1")
+}
+
+func TestQueryLoggerWithRequestIDScopesDedupStateSeparately(t *testing.T) {
+	var buf bytes.Buffer
+	base := NewQueryLogger(slog.New(slog.NewTextHandler(&buf, nil)))
+
+	// Two different requests should not suppress each other's warnings.
+	base.WithRequestID("req-1").Warn("subquery range exceeds retention")
+	base.WithRequestID("req-2").Warn("subquery range exceeds retention")
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	require.Len(t, lines, 2)
+}
@@ -21,15 +21,15 @@
 package prom
 
 import (
+	"log/slog"
 	"net/http"
 	"time"
 
 	"github.com/m3db/m3/src/query/api/v1/options"
-	"github.com/m3db/m3/src/query/block"
 	"github.com/m3db/m3/src/query/storage/prometheus"
+	"github.com/m3db/m3/src/x/instrument"
 
 	"github.com/prometheus/prometheus/promql"
-	"github.com/prometheus/prometheus/promql/parser"
 )
 
 // NB: since Prometheus engine is not brought up in the usual fashion,
@@ -41,14 +41,83 @@ func init() {
 // Options defines options for PromQL handler.
 type Options struct {
 	PromQLEngine *promql.Engine
-	instant bool
+	instant      bool
+
+	// EnableNativeHistograms lets the handler's queryable detect Prometheus
+	// native (sparse) histogram samples in M3DB storage and record their
+	// presence in the query's block.ResultMetadata. The PromQL engine still
+	// sees each such sample as its stored float value (the histogram's Sum),
+	// not as a histogram, so histogram functions such as histogram_quantile
+	// do not evaluate over native histograms. The queryable decodes each
+	// datapoint's annotation via prometheus.DecodeNativeHistogramAnnotation,
+	// which the
+	// rw2.0 ingestion path (remote_write_v2.go) populates with
+	// prometheus.EncodeNativeHistogramAnnotation when it writes a native
+	// histogram sample.
+	EnableNativeHistograms bool
+
+	// QueryLogger is scoped to each request's correlation ID and attached to
+	// the request context. Only code that reads it from the context logs
+	// through it (ApplyRangeWarningsWithContext and the remote write 2.0
+	// exemplar warning); the read handler's own logging still goes through
+	// hOpts' logger. Defaults to a QueryLogger over slog.Default().
+	QueryLogger *QueryLogger
+
+	// EnginePool, if set, overrides PromQLEngine: each request resolves its
+	// tenant (see TenantResolver) and is evaluated against that tenant's own
+	// engine, built per the resource limits config returns for it.
+	EnginePool *EnginePool
+
+	// TenantResolver extracts the tenant a request is evaluated under, for
+	// use with EnginePool. Defaults to the M3-Tenant and X-Scope-OrgID
+	// headers if unset.
+	TenantResolver func(*http.Request) string
 }
 
 func (o Options) WithInstant(instant bool) Options {
-	return Options{
-		PromQLEngine: o.PromQLEngine,
-		instant:      instant,
-	}
+	o.instant = instant
+	return o
+}
+
+// WithNativeHistograms toggles native histogram detection on the handler's
+// queryable; see EnableNativeHistograms. The PromQL engine is not changed.
+func (o Options) WithNativeHistograms(enabled bool) Options {
+	o.EnableNativeHistograms = enabled
+	return o
+}
+
+// WithQueryLogger attaches a QueryLogger that NewReadHandlerWithHooks scopes
+// to each request's correlation ID.
+func (o Options) WithQueryLogger(logger *QueryLogger) Options {
+	o.QueryLogger = logger
+	return o
+}
+
+// WithEnginePool switches the handler from a single shared PromQLEngine to
+// per-tenant engines drawn from pool.
+func (o Options) WithEnginePool(pool *EnginePool) Options {
+	o.EnginePool = pool
+	return o
+}
+
+// WithEnginePoolFromConfig builds an EnginePool from config - typically the
+// dynamic config system's view of per-tenant overrides - and attaches it in
+// place of PromQLEngine. maxIdle and queryLogDir are forwarded to
+// NewEnginePool as-is; see its doc comment.
+func (o Options) WithEnginePoolFromConfig(
+	maxIdle int,
+	config TenantEngineConfigSource,
+	queryLogDir string,
+	instrumentOpts instrument.Options,
+) Options {
+	return o.WithEnginePool(NewEnginePool(maxIdle, config, queryLogDir, instrumentOpts))
+}
+
+// WithTenantResolver overrides how a request's tenant is resolved when
+// EnginePool is set.
+func (o Options) WithTenantResolver(resolver func(*http.Request) string) Options {
+	o.TenantResolver = resolver
+	return o
 }
 
 // NewReadHandler creates a handler to handle PromQL requests.
@@ -64,29 +133,41 @@ func NewReadHandlerWithHooks(
 ) http.Handler {
 	queryable := prometheus.NewPrometheusQueryable(
 		prometheus.PrometheusOptions{
-			Storage:           hOpts.Storage(),
-			InstrumentOptions: hOpts.InstrumentOpts(),
+			Storage:                hOpts.Storage(),
+			InstrumentOptions:      hOpts.InstrumentOpts(),
+			EnableNativeHistograms: opts.EnableNativeHistograms,
 		})
 
-	return newReadHandler(opts, hOpts, hooks, queryable)
+	if opts.EnginePool == nil {
+		return withQueryLogging(opts, newReadHandler(opts, hOpts, hooks, queryable))
+	}
+
+	// Per-tenant engines: each request resolves its tenant and is served by
+	// a handler built against that tenant's pooled engine, rather than the
+	// single PromQLEngine newReadHandler would otherwise close over.
+	perTenant := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tenantOpts := opts
+		tenantOpts.PromQLEngine = opts.EnginePool.Engine(resolveTenant(r, opts))
+		newReadHandler(tenantOpts, hOpts, hooks, queryable).ServeHTTP(w, r)
+	})
+
+	return withQueryLogging(opts, perTenant)
 }
 
-// ApplyRangeWarnings applies warnings encountered during execution.
-func ApplyRangeWarnings(
-	query string, meta *block.ResultMetadata,
-) error {
-	expr, err := parser.ParseExpr(query)
-	if err != nil {
-		return err
+// withQueryLogging resolves (or mints) a correlation ID for every request,
+// scopes opts.QueryLogger to it, attaches the scoped logger to the request
+// context and echoes the ID in the X-Request-ID response header. Code that
+// logs through queryLoggerFromContext picks the scoped logger up; logging
+// inside newReadHandler does not use it.
+func withQueryLogging(opts Options, next http.Handler) http.Handler {
+	base := opts.QueryLogger
+	if base == nil {
+		base = NewQueryLogger(slog.Default())
 	}
 
-	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
-		if n, ok := node.(*parser.MatrixSelector); ok {
-			meta.VerifyTemporalRange(n.Range)
-		}
-
-		return nil
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, requestID := withCorrelatedQueryLogger(r, base)
+		w.Header().Set(requestIDHeader, requestID)
+		next.ServeHTTP(w, r.WithContext(ctx))
 	})
-
-	return nil
 }
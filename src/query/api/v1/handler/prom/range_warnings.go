@@ -0,0 +1,180 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/m3db/m3/src/query/block"
+
+	"github.com/prometheus/prometheus/promql/parser"
+)
+
+// mixedHistogramTypesWarningFormat is emitted when a query's result set mixes
+// classic (float) histogram buckets with Prometheus native (sparse)
+// histogram samples over the queried range, since PromQL functions such as
+// histogram_quantile cannot combine the two representations meaningfully.
+const mixedHistogramTypesWarningFormat = "query \"%s\" touches series with both classic and native histogram samples in range"
+
+// ApplyRangeWarnings applies warnings encountered during execution.
+//
+// It walks the parsed query for both matrix selectors (e.g. rate(x[1m])) and
+// subqueries (e.g. max_over_time(rate(x[1m])[1h:])), passing the effective
+// lookback each contributes to meta.VerifyTemporalRange, which warns when a
+// resolution recorded on meta is coarser than that lookback. Namespace
+// retention is not consulted. A subquery's effective range is its own range
+// plus the widest matrix selector range nested inside it (and any enclosing
+// subquery ranges along the walk's path, since nested subqueries compound).
+// A positive offset adds to the lookback; negative offsets and the @
+// modifier add nothing.
+func ApplyRangeWarnings(
+	query string, meta *block.ResultMetadata,
+) error {
+	expr, err := parser.ParseExpr(query)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range effectiveLookbackRanges(expr) {
+		meta.VerifyTemporalRange(r)
+	}
+
+	if meta.IsMixedHistogramType() {
+		meta.AddWarning("mixed-histogram-types", fmt.Sprintf(mixedHistogramTypesWarningFormat, query))
+	}
+
+	return nil
+}
+
+// ApplyRangeWarningsWithContext behaves like ApplyRangeWarnings, additionally
+// logging every warning it adds to meta through the QueryLogger attached to
+// ctx by withQueryLogging, so each is correlated to the request's ID.
+func ApplyRangeWarningsWithContext(
+	ctx context.Context, query string, meta *block.ResultMetadata,
+) error {
+	if err := ApplyRangeWarnings(query, meta); err != nil {
+		return err
+	}
+
+	logger := queryLoggerFromContext(ctx)
+	for _, warning := range meta.Warnings {
+		logger.Warn("range warning", "query", query, "warning", warning.Message)
+	}
+
+	return nil
+}
+
+// effectiveLookbackRanges walks expr and returns, for every matrix selector
+// and subquery in it, the total effective lookback duration that node
+// contributes - its own range plus that of any subqueries it is nested
+// inside of (which compound) plus, for subqueries, the widest matrix
+// selector range found inside them.
+func effectiveLookbackRanges(expr parser.Expr) []time.Duration {
+	var ranges []time.Duration
+	parser.Inspect(expr, func(node parser.Node, path []parser.Node) error {
+		switch n := node.(type) {
+		case *parser.MatrixSelector:
+			ranges = append(ranges, n.Range+offsetOf(n)+enclosingSubqueryRange(path))
+		case *parser.SubqueryExpr:
+			ranges = append(ranges, n.Range+offsetDuration(n.Offset, n.OriginalOffset)+
+				enclosingSubqueryRange(path)+maxDescendantMatrixRange(n.Expr))
+		}
+
+		return nil
+	})
+
+	return ranges
+}
+
+// enclosingSubqueryRange sums the ranges of every *parser.SubqueryExpr found
+// along path, i.e. all subqueries that the current node is nested inside of.
+// Nested subqueries compound: max_over_time(rate(x[1m])[1h:])[1d:] looks
+// back 1d + 1h + 1m from "now", not just 1d.
+func enclosingSubqueryRange(path []parser.Node) time.Duration {
+	var total time.Duration
+	for _, node := range path {
+		if sq, ok := node.(*parser.SubqueryExpr); ok {
+			total += sq.Range + offsetDuration(sq.Offset, sq.OriginalOffset)
+		}
+	}
+
+	return total
+}
+
+// maxDescendantMatrixRange returns the widest effective range contributed by
+// anything nested inside expr, which is the amount of additional lookback a
+// subquery wrapping expr needs beyond its own range: either a
+// *parser.MatrixSelector's own range (e.g. the "[1m]" in
+// max_over_time(rate(x[1m])[1h:])), or - recursively, since nested
+// subqueries compound - a nested *parser.SubqueryExpr's own range plus
+// whatever it needs beyond that. A flat scan for the widest MatrixSelector
+// or SubqueryExpr anywhere in expr isn't enough: it has to recurse through
+// each subquery it finds rather than stop at its range, or a doubly-nested
+// subquery under-reports by however much lookback its own inner subquery/
+// matrix selector adds.
+func maxDescendantMatrixRange(expr parser.Node) time.Duration {
+	switch n := expr.(type) {
+	case *parser.MatrixSelector:
+		return n.Range + offsetOf(n)
+	case *parser.SubqueryExpr:
+		return n.Range + offsetDuration(n.Offset, n.OriginalOffset) + maxDescendantMatrixRange(n.Expr)
+	}
+
+	// Children are walked as plain Nodes: a Call's arguments come back as a
+	// parser.Expressions node, which is not itself a parser.Expr.
+	var maxRange time.Duration
+	for _, child := range parser.Children(expr) {
+		if r := maxDescendantMatrixRange(child); r > maxRange {
+			maxRange = r
+		}
+	}
+
+	return maxRange
+}
+
+// offsetOf returns the offset of the vector selector underlying a matrix
+// selector, normalized by offsetDuration.
+func offsetOf(n *parser.MatrixSelector) time.Duration {
+	if vs, ok := n.VectorSelector.(*parser.VectorSelector); ok {
+		return offsetDuration(vs.Offset, vs.OriginalOffset)
+	}
+
+	return 0
+}
+
+// offsetDuration normalizes a node's offset to a non-negative duration:
+// classic offsets already look backwards, while a negative offset shifts the
+// window forward and so adds nothing to how far back we must look. The @
+// modifier is held in separate fields (Timestamp/StartOrEnd) and is not
+// read here, so it adds nothing either.
+func offsetDuration(offset, originalOffset time.Duration) time.Duration {
+	if offset > 0 {
+		return offset
+	}
+
+	if originalOffset > 0 {
+		return originalOffset
+	}
+
+	return 0
+}
@@ -0,0 +1,80 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/prometheus/promql/parser"
+
+	"github.com/stretchr/testify/require"
+)
+
+func mustParseExpr(t *testing.T, query string) parser.Expr {
+	expr, err := parser.ParseExpr(query)
+	require.NoError(t, err)
+	return expr
+}
+
+func TestEffectiveLookbackRangesNestedSubquery(t *testing.T) {
+	// max_over_time(rate(x[1m])[1h:]) should verify 1h (subquery) + 1m
+	// (nested matrix selector), not just 1h. Both the subquery node and the
+	// matrix selector node independently compute the same total, by
+	// different paths (the subquery via its descendant's range, the matrix
+	// selector via its enclosing subquery's range) - asserting the full
+	// slice, not just containment, catches either path reporting the wrong
+	// value even when the other masks it.
+	ranges := effectiveLookbackRanges(mustParseExpr(t, `max_over_time(rate(x[1m])[1h:])`))
+	require.Equal(t, []time.Duration{time.Hour + time.Minute, time.Hour + time.Minute}, ranges)
+}
+
+func TestEffectiveLookbackRangesDoublyNestedSubquery(t *testing.T) {
+	// A subquery nested inside another subquery compounds: the outer [1d:]
+	// must also account for the inner [1h:] plus its [1m] selector, not
+	// just the inner [1h:]. All three nodes visited (outer subquery, inner
+	// subquery, innermost matrix selector) independently compute the same
+	// 25h1m total; asserting the full slice (rather than require.Contains)
+	// would have caught the outer subquery node under-reporting 25h while
+	// the innermost matrix selector's correct 25h1m masked it.
+	ranges := effectiveLookbackRanges(mustParseExpr(t, `max_over_time(max_over_time(rate(x[1m])[1h:])[1d:])`))
+	want := 24*time.Hour + time.Hour + time.Minute
+	require.Equal(t, []time.Duration{want, want, want}, ranges)
+}
+
+func TestEffectiveLookbackRangesAtModifier(t *testing.T) {
+	// @ start()/@ end() pin the evaluation timestamp rather than shifting
+	// the lookback window backwards, so they should not add to the range.
+	ranges := effectiveLookbackRanges(mustParseExpr(t, `rate(x[1m] @ start())`))
+	require.Equal(t, []time.Duration{time.Minute}, ranges)
+}
+
+func TestEffectiveLookbackRangesNegativeOffset(t *testing.T) {
+	// A negative offset shifts the window forward in time; it should not
+	// be treated as additional backwards lookback.
+	ranges := effectiveLookbackRanges(mustParseExpr(t, `rate(x[1m] offset -10m)`))
+	require.Equal(t, []time.Duration{time.Minute}, ranges)
+}
+
+func TestEffectiveLookbackRangesPositiveOffset(t *testing.T) {
+	ranges := effectiveLookbackRanges(mustParseExpr(t, `rate(x[1m] offset 10m)`))
+	require.Equal(t, []time.Duration{11 * time.Minute}, ranges)
+}
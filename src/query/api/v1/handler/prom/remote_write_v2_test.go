@@ -0,0 +1,137 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prom
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/m3db/m3/src/query/storage"
+	prometheusstorage "github.com/m3db/m3/src/query/storage/prometheus"
+
+	"github.com/golang/snappy"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+	"github.com/stretchr/testify/require"
+)
+
+var errTestWrite = errors.New("fake write failure")
+
+type fakeSeriesWriter struct {
+	writes []*storage.WriteQuery
+	failAt int // -1 disables; otherwise fails the write at this call index
+}
+
+func (w *fakeSeriesWriter) Write(_ context.Context, query *storage.WriteQuery) error {
+	defer func() { w.writes = append(w.writes, query) }()
+	if w.failAt >= 0 && len(w.writes) == w.failAt {
+		return errTestWrite
+	}
+	return nil
+}
+
+func encodeV2Request(t *testing.T, req *writev2.Request) []byte {
+	t.Helper()
+	marshaled, err := req.Marshal()
+	require.NoError(t, err)
+	return snappy.Encode(nil, marshaled)
+}
+
+func TestWriteRemoteWriteV2RequestSamplesAndHistogramsRoundTrip(t *testing.T) {
+	req := &writev2.Request{
+		Symbols: []string{"", "__name__", "cpu", "job", "job1"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Samples:    []writev2.Sample{{Value: 42, Timestamp: 1000}},
+			},
+			{
+				LabelsRefs: []uint32{1, 2, 3, 4},
+				Histograms: []writev2.Histogram{{
+					Count:     &writev2.Histogram_CountInt{CountInt: 5},
+					Sum:       10.5,
+					Schema:    1,
+					Timestamp: 2000,
+				}},
+			},
+		},
+	}
+
+	body := bytes.NewReader(encodeV2Request(t, req))
+	writer := &fakeSeriesWriter{failAt: -1}
+
+	result, err := writeRemoteWriteV2Request(context.Background(), body, writer)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.samples)
+	require.Equal(t, 1, result.histograms)
+	require.Equal(t, 0, result.exemplarsDropped)
+	require.Len(t, writer.writes, 2)
+
+	// The histogram write must carry a decodable native histogram
+	// annotation rather than just its Sum as a bare float.
+	histWrite := writer.writes[1]
+	require.Len(t, histWrite.Datapoints, 1)
+	decoded, ok, err := prometheusstorage.DecodeNativeHistogramAnnotation(histWrite.Datapoints[0].Annotation)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, int32(1), decoded.Schema)
+}
+
+func TestWriteRemoteWriteV2RequestDropsExemplars(t *testing.T) {
+	req := &writev2.Request{
+		Symbols: []string{"", "__name__", "cpu"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2},
+				Exemplars:  []writev2.Exemplar{{Value: 1, Timestamp: 1000}},
+			},
+		},
+	}
+
+	body := bytes.NewReader(encodeV2Request(t, req))
+	writer := &fakeSeriesWriter{failAt: -1}
+
+	result, err := writeRemoteWriteV2Request(context.Background(), body, writer)
+	require.NoError(t, err)
+	require.Equal(t, 1, result.exemplarsDropped)
+	require.Empty(t, writer.writes)
+}
+
+func TestWriteRemoteWriteV2RequestRecordsPerSeriesWriteErrors(t *testing.T) {
+	req := &writev2.Request{
+		Symbols: []string{"", "__name__", "cpu"},
+		Timeseries: []writev2.TimeSeries{
+			{
+				LabelsRefs: []uint32{1, 2},
+				Samples:    []writev2.Sample{{Value: 1, Timestamp: 1000}},
+			},
+		},
+	}
+
+	body := bytes.NewReader(encodeV2Request(t, req))
+	writer := &fakeSeriesWriter{failAt: 0}
+
+	result, err := writeRemoteWriteV2Request(context.Background(), body, writer)
+	require.NoError(t, err)
+	require.Equal(t, 0, result.samples)
+	require.Len(t, result.seriesErrors, 1)
+}
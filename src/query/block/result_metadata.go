@@ -0,0 +1,137 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package block holds the result metadata types the query path attaches to a
+// query's execution - today, just the subset a PromQL-facing queryable needs
+// to surface store-side warnings about the data it read.
+package block
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Warning is a single warning surfaced by a query, identifying the
+// originating store/check via Name and carrying a human-readable Message.
+type Warning struct {
+	// Name is the name of the check or store originating the warning.
+	Name string
+	// Message is the content of the warning message.
+	Message string
+}
+
+// Header formats the warning for inclusion in a response header.
+func (w Warning) Header() string {
+	return fmt.Sprintf("%s_%s", w.Name, w.Message)
+}
+
+func (w Warning) equals(other Warning) bool {
+	return w.Name == other.Name && w.Message == other.Message
+}
+
+// Warnings is a slice of warnings.
+type Warnings []Warning
+
+func (w Warnings) addWarning(next Warning) Warnings {
+	for _, existing := range w {
+		if existing.equals(next) {
+			return w
+		}
+	}
+
+	return append(w, next)
+}
+
+// ResultMetadata describes metadata accumulated while executing a query
+// against the queryable: warnings to surface to the caller, the resolutions
+// of series it touched, and whether the series it read mixed classic (float)
+// and native (sparse) histogram samples.
+type ResultMetadata struct {
+	// Warnings is a list of warnings that indicate potentially partial,
+	// incomplete, or otherwise noteworthy results.
+	Warnings Warnings
+	// Resolutions is a list of resolutions for series obtained by this
+	// query, checked against the queried range by VerifyTemporalRange.
+	Resolutions []time.Duration
+
+	// SawClassicHistogramSample is set once this result has included a
+	// classic (float bucket) histogram sample.
+	SawClassicHistogramSample bool
+	// SawNativeHistogramSample is set once this result has included a
+	// Prometheus native (sparse) histogram sample.
+	SawNativeHistogramSample bool
+}
+
+// NewResultMetadata creates a new, empty result metadata.
+func NewResultMetadata() ResultMetadata {
+	return ResultMetadata{}
+}
+
+// AddWarning adds a warning to the result metadata, deduplicating against
+// any warning already present with the same name and message.
+func (m *ResultMetadata) AddWarning(name, message string) {
+	m.Warnings = m.Warnings.addWarning(Warning{Name: name, Message: message})
+}
+
+// VerifyTemporalRange checks each resolution recorded on m against step,
+// adding a warning if any resolution exceeds it - i.e. the data m describes
+// is coarser than the range the query asked it to cover.
+func (m *ResultMetadata) VerifyTemporalRange(step time.Duration) {
+	invalidResolutions := make(map[time.Duration]struct{}, len(m.Resolutions))
+	for _, res := range m.Resolutions {
+		if res > step {
+			invalidResolutions[res] = struct{}{}
+		}
+	}
+
+	if len(invalidResolutions) == 0 {
+		return
+	}
+
+	warnings := make([]string, 0, len(invalidResolutions))
+	for res := range invalidResolutions {
+		warnings = append(warnings, res.String())
+	}
+	sort.Strings(warnings)
+
+	m.AddWarning("resolution larger than query range",
+		fmt.Sprintf("range: %v, resolutions: %s", step, strings.Join(warnings, ", ")))
+}
+
+// RecordHistogramSample marks that a sample of the given kind was read while
+// building this result, so IsMixedHistogramType can later detect whether both
+// kinds showed up in the same result.
+func (m *ResultMetadata) RecordHistogramSample(native bool) {
+	if native {
+		m.SawNativeHistogramSample = true
+		return
+	}
+
+	m.SawClassicHistogramSample = true
+}
+
+// IsMixedHistogramType reports whether this result included both classic and
+// native histogram samples, which PromQL functions such as histogram_quantile
+// cannot meaningfully combine.
+func (m ResultMetadata) IsMixedHistogramType() bool {
+	return m.SawClassicHistogramSample && m.SawNativeHistogramSample
+}
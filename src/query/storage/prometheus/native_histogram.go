@@ -0,0 +1,70 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"bytes"
+	"fmt"
+
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+// nativeHistogramAnnotationPrefix tags a datapoint's Annotation bytes as
+// carrying a proto-marshaled rw2.0 native histogram, distinguishing them from
+// M3's other uses of Annotation (e.g. counter reset hints). The remote write
+// 2.0 ingestion path (EncodeNativeHistogramAnnotation) and this package's
+// queryable (DecodeNativeHistogramAnnotation, consulted when
+// PrometheusOptions.EnableNativeHistograms is set) must agree on this
+// encoding.
+var nativeHistogramAnnotationPrefix = []byte("nh1:")
+
+// EncodeNativeHistogramAnnotation marshals h into the Annotation bytes
+// written alongside the float placeholder value M3 stores for a native
+// histogram sample, so that a read path with native histogram support
+// enabled can reconstruct the original histogram rather than just the
+// placeholder.
+func EncodeNativeHistogramAnnotation(h *writev2.Histogram) ([]byte, error) {
+	marshaled, err := h.Marshal()
+	if err != nil {
+		return nil, fmt.Errorf("marshal native histogram: %w", err)
+	}
+
+	annotation := make([]byte, 0, len(nativeHistogramAnnotationPrefix)+len(marshaled))
+	annotation = append(annotation, nativeHistogramAnnotationPrefix...)
+	annotation = append(annotation, marshaled...)
+	return annotation, nil
+}
+
+// DecodeNativeHistogramAnnotation reverses EncodeNativeHistogramAnnotation.
+// ok is false if annotation is not a native histogram annotation (e.g. it's
+// empty, or tagged for one of Annotation's other uses), in which case the
+// datapoint should be treated as an ordinary float sample.
+func DecodeNativeHistogramAnnotation(annotation []byte) (h writev2.Histogram, ok bool, err error) {
+	if !bytes.HasPrefix(annotation, nativeHistogramAnnotationPrefix) {
+		return writev2.Histogram{}, false, nil
+	}
+
+	if err := h.Unmarshal(annotation[len(nativeHistogramAnnotationPrefix):]); err != nil {
+		return writev2.Histogram{}, false, fmt.Errorf("unmarshal native histogram annotation: %w", err)
+	}
+
+	return h, true, nil
+}
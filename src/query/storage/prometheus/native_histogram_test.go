@@ -0,0 +1,62 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+)
+
+func TestNativeHistogramAnnotationRoundTrip(t *testing.T) {
+	h := &writev2.Histogram{
+		Count:         &writev2.Histogram_CountInt{CountInt: 12},
+		Sum:           3.5,
+		Schema:        2,
+		ZeroThreshold: 0.001,
+		ZeroCount:     &writev2.Histogram_ZeroCountInt{ZeroCountInt: 1},
+		Timestamp:     1700000000000,
+	}
+
+	annotation, err := EncodeNativeHistogramAnnotation(h)
+	require.NoError(t, err)
+
+	decoded, ok, err := DecodeNativeHistogramAnnotation(annotation)
+	require.NoError(t, err)
+	require.True(t, ok)
+	require.Equal(t, h.Sum, decoded.Sum)
+	require.Equal(t, h.Schema, decoded.Schema)
+	require.Equal(t, h.Timestamp, decoded.Timestamp)
+}
+
+func TestDecodeNativeHistogramAnnotationNotAHistogram(t *testing.T) {
+	_, ok, err := DecodeNativeHistogramAnnotation([]byte("some-other-annotation"))
+	require.NoError(t, err)
+	require.False(t, ok)
+}
+
+func TestDecodeNativeHistogramAnnotationEmpty(t *testing.T) {
+	_, ok, err := DecodeNativeHistogramAnnotation(nil)
+	require.NoError(t, err)
+	require.False(t, ok)
+}
@@ -0,0 +1,238 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"context"
+	"time"
+
+	"github.com/m3db/m3/src/query/block"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	"github.com/m3db/m3/src/x/instrument"
+
+	"github.com/prometheus/prometheus/model/labels"
+	"github.com/prometheus/prometheus/tsdb/chunkenc"
+
+	promstorage "github.com/prometheus/prometheus/storage"
+)
+
+// FetchedSeries is a single series as a SeriesFetcher returns it: its tags
+// and the raw datapoints M3 stored for it, including each datapoint's
+// Annotation (e.g. a native histogram encoded via
+// EncodeNativeHistogramAnnotation).
+type FetchedSeries struct {
+	Tags       models.Tags
+	Datapoints ts.Datapoints
+}
+
+// SeriesFetcher is the subset of storage.Storage's read path
+// NewPrometheusQueryable needs, narrowed (the same way seriesWriter narrows
+// the write path in remote_write_v2.go) so tests can exercise it with a fake
+// rather than a full storage.Storage implementation.
+type SeriesFetcher interface {
+	FetchByMatchers(
+		ctx context.Context,
+		matchers []*labels.Matcher,
+		start, end time.Time,
+	) ([]FetchedSeries, error)
+}
+
+// PrometheusOptions configures NewPrometheusQueryable.
+type PrometheusOptions struct {
+	// Storage is the series fetcher the queryable reads from.
+	Storage SeriesFetcher
+	// InstrumentOptions scopes metrics/logging for the queryable.
+	InstrumentOptions instrument.Options
+	// EnableNativeHistograms lets the queryable detect Prometheus native
+	// (sparse) histogram samples from M3DB storage, decoding each
+	// datapoint's annotation via DecodeNativeHistogramAnnotation and
+	// recording their presence in the querier's block.ResultMetadata.
+	// Samples are still returned as plain floats either way. If false,
+	// annotations are not examined.
+	EnableNativeHistograms bool
+}
+
+// PrometheusQueryable adapts a SeriesFetcher into a Prometheus
+// storage.Queryable, so the handler's PromQL engine can evaluate directly
+// against M3 data.
+type PrometheusQueryable struct {
+	opts PrometheusOptions
+}
+
+// NewPrometheusQueryable returns a PrometheusQueryable backed by opts.
+func NewPrometheusQueryable(opts PrometheusOptions) *PrometheusQueryable {
+	return &PrometheusQueryable{opts: opts}
+}
+
+// Querier implements promstorage.Queryable. Any warnings and
+// histogram-mixing state observed while querying are discarded; call
+// QuerierWithMetadata to capture them.
+func (q *PrometheusQueryable) Querier(mint, maxt int64) (promstorage.Querier, error) {
+	return q.QuerierWithMetadata(mint, maxt, &block.ResultMetadata{})
+}
+
+// QuerierWithMetadata behaves like Querier, additionally recording into meta
+// whether the series it reads mix classic and native histogram samples, so
+// the caller can pass meta on to ApplyRangeWarnings once the query using
+// this querier has finished executing.
+func (q *PrometheusQueryable) QuerierWithMetadata(
+	mint, maxt int64,
+	meta *block.ResultMetadata,
+) (promstorage.Querier, error) {
+	return &prometheusQuerier{opts: q.opts, mint: mint, maxt: maxt, meta: meta}, nil
+}
+
+type prometheusQuerier struct {
+	opts       PrometheusOptions
+	mint, maxt int64
+	meta       *block.ResultMetadata
+}
+
+func (q *prometheusQuerier) Select(
+	sortSeries bool,
+	hints *promstorage.SelectHints,
+	matchers ...*labels.Matcher,
+) promstorage.SeriesSet {
+	fetched, err := q.opts.Storage.FetchByMatchers(
+		context.Background(), matchers, time.UnixMilli(q.mint), time.UnixMilli(q.maxt))
+	if err != nil {
+		return promstorage.ErrSeriesSet(err)
+	}
+
+	series := make([]promstorage.Series, 0, len(fetched))
+	for _, s := range fetched {
+		series = append(series, q.toPromSeries(s))
+	}
+
+	return &prometheusSeriesSet{series: series}
+}
+
+// toPromSeries converts a single FetchedSeries into a Prometheus series,
+// recording its histogram type (classic, native, or neither) into q.meta -
+// the real decode step into the queryable: when EnableNativeHistograms is
+// set, each datapoint's annotation is decoded via
+// DecodeNativeHistogramAnnotation to tell native histogram samples apart
+// from plain floats, rather than leaving that annotation unexamined on the
+// read path.
+func (q *prometheusQuerier) toPromSeries(s FetchedSeries) promstorage.Series {
+	isNativeHistogram := false
+	if q.opts.EnableNativeHistograms {
+		for _, dp := range s.Datapoints {
+			if _, ok, err := DecodeNativeHistogramAnnotation(dp.Annotation); err == nil && ok {
+				isNativeHistogram = true
+				break
+			}
+		}
+	}
+
+	if isNativeHistogram {
+		q.meta.RecordHistogramSample(true /* native */)
+	} else if isClassicHistogramSample(s.Tags) {
+		q.meta.RecordHistogramSample(false /* native */)
+	}
+
+	return &prometheusSeries{tags: s.Tags, datapoints: s.Datapoints}
+}
+
+// isClassicHistogramSample reports whether tags identify a classic (float
+// bucket) histogram series: one carrying the "le" bucket-boundary label, the
+// same signal Prometheus' own histogram_quantile uses to find bucket series.
+func isClassicHistogramSample(tags models.Tags) bool {
+	_, ok := tags.Get([]byte(labels.BucketLabel))
+	return ok
+}
+
+func tagsToLabels(tags models.Tags) labels.Labels {
+	lbls := make(labels.Labels, 0, tags.Len())
+	for _, tag := range tags.Tags {
+		lbls = append(lbls, labels.Label{Name: string(tag.Name), Value: string(tag.Value)})
+	}
+
+	return lbls
+}
+
+func (q *prometheusQuerier) LabelValues(string, ...*labels.Matcher) ([]string, promstorage.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (q *prometheusQuerier) LabelNames(...*labels.Matcher) ([]string, promstorage.Warnings, error) {
+	return nil, nil, nil
+}
+
+func (q *prometheusQuerier) Close() error { return nil }
+
+type prometheusSeriesSet struct {
+	series []promstorage.Series
+	idx    int
+}
+
+func (s *prometheusSeriesSet) Next() bool {
+	s.idx++
+	return s.idx <= len(s.series)
+}
+
+func (s *prometheusSeriesSet) At() promstorage.Series         { return s.series[s.idx-1] }
+func (s *prometheusSeriesSet) Err() error                     { return nil }
+func (s *prometheusSeriesSet) Warnings() promstorage.Warnings { return nil }
+
+// prometheusSeries adapts a FetchedSeries to promstorage.Series. Whatever
+// decoded a datapoint's annotation (toPromSeries, above) already happened by
+// the time a series reaches here; its datapoints' plain Values are what the
+// PromQL engine evaluates over, matching how the rw2.0 write path itself
+// stores a native histogram sample's scalar value (see remote_write_v2.go).
+type prometheusSeries struct {
+	tags       models.Tags
+	datapoints ts.Datapoints
+}
+
+func (s *prometheusSeries) Labels() labels.Labels { return tagsToLabels(s.tags) }
+
+func (s *prometheusSeries) Iterator() chunkenc.Iterator {
+	return &prometheusSeriesIterator{datapoints: s.datapoints, idx: -1}
+}
+
+type prometheusSeriesIterator struct {
+	datapoints ts.Datapoints
+	idx        int
+}
+
+func (it *prometheusSeriesIterator) Seek(t int64) bool {
+	for it.idx++; it.idx < len(it.datapoints); it.idx++ {
+		if it.datapoints[it.idx].Timestamp.ToTime().UnixMilli() >= t {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (it *prometheusSeriesIterator) At() (int64, float64) {
+	dp := it.datapoints[it.idx]
+	return dp.Timestamp.ToTime().UnixMilli(), dp.Value
+}
+
+func (it *prometheusSeriesIterator) Next() bool {
+	it.idx++
+	return it.idx < len(it.datapoints)
+}
+
+func (it *prometheusSeriesIterator) Err() error { return nil }
@@ -0,0 +1,177 @@
+// Copyright (c) 2024 Uber Technologies, Inc.
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package prometheus
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/m3db/m3/src/query/block"
+	"github.com/m3db/m3/src/query/models"
+	"github.com/m3db/m3/src/query/ts"
+	xtime "github.com/m3db/m3/src/x/time"
+
+	"github.com/prometheus/prometheus/model/labels"
+	writev2 "github.com/prometheus/prometheus/prompb/io/prometheus/write/v2"
+
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSeriesFetcher is a SeriesFetcher backed by a fixed set of series,
+// ignoring matchers/start/end (the tests below only ever select everything).
+type fakeSeriesFetcher struct {
+	series []FetchedSeries
+}
+
+func (f *fakeSeriesFetcher) FetchByMatchers(
+	context.Context, []*labels.Matcher, time.Time, time.Time,
+) ([]FetchedSeries, error) {
+	return f.series, nil
+}
+
+func tagsOf(pairs ...string) models.Tags {
+	tags := models.NewTags(len(pairs)/2, models.NewTagOptions())
+	for i := 0; i < len(pairs); i += 2 {
+		tags = tags.AddTag(models.Tag{Name: []byte(pairs[i]), Value: []byte(pairs[i+1])})
+	}
+
+	return tags
+}
+
+func TestPrometheusQuerierSelectPlainFloatSample(t *testing.T) {
+	fetcher := &fakeSeriesFetcher{series: []FetchedSeries{
+		{
+			Tags: tagsOf("__name__", "cpu", "job", "job1"),
+			Datapoints: ts.Datapoints{
+				{Timestamp: xtime.FromSeconds(1700000000), Value: 42},
+			},
+		},
+	}}
+
+	queryable := NewPrometheusQueryable(PrometheusOptions{Storage: fetcher})
+	meta := &block.ResultMetadata{}
+	querier, err := queryable.QuerierWithMetadata(1700000000000, 1700000001000, meta)
+	require.NoError(t, err)
+	defer querier.Close()
+
+	set := querier.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu"))
+	require.True(t, set.Next())
+	require.NoError(t, set.Err())
+
+	series := set.At()
+	it := series.Iterator()
+	require.True(t, it.Next())
+	gotTimestamp, gotValue := it.At()
+	require.Equal(t, int64(1700000000000), gotTimestamp)
+	require.Equal(t, 42.0, gotValue)
+
+	require.False(t, meta.IsMixedHistogramType())
+	require.False(t, meta.SawNativeHistogramSample)
+	require.False(t, meta.SawClassicHistogramSample)
+}
+
+func TestPrometheusQuerierSelectRecordsNativeHistogramSample(t *testing.T) {
+	h := &writev2.Histogram{Sum: 7, Timestamp: 1700000000000}
+	annotation, err := EncodeNativeHistogramAnnotation(h)
+	require.NoError(t, err)
+
+	fetcher := &fakeSeriesFetcher{series: []FetchedSeries{
+		{
+			Tags: tagsOf("__name__", "cpu_native_histogram"),
+			Datapoints: ts.Datapoints{
+				{Timestamp: xtime.FromSeconds(1700000000), Value: h.Sum, Annotation: annotation},
+			},
+		},
+	}}
+
+	queryable := NewPrometheusQueryable(PrometheusOptions{Storage: fetcher, EnableNativeHistograms: true})
+	meta := &block.ResultMetadata{}
+	querier, err := queryable.QuerierWithMetadata(0, 0, meta)
+	require.NoError(t, err)
+	defer querier.Close()
+
+	set := querier.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_native_histogram"))
+	require.True(t, set.Next())
+
+	require.True(t, meta.SawNativeHistogramSample)
+	require.False(t, meta.SawClassicHistogramSample)
+}
+
+func TestPrometheusQuerierSelectIgnoresNativeHistogramAnnotationWhenDisabled(t *testing.T) {
+	h := &writev2.Histogram{Sum: 7, Timestamp: 1700000000000}
+	annotation, err := EncodeNativeHistogramAnnotation(h)
+	require.NoError(t, err)
+
+	fetcher := &fakeSeriesFetcher{series: []FetchedSeries{
+		{
+			Tags: tagsOf("__name__", "cpu_native_histogram"),
+			Datapoints: ts.Datapoints{
+				{Timestamp: xtime.FromSeconds(1700000000), Value: h.Sum, Annotation: annotation},
+			},
+		},
+	}}
+
+	queryable := NewPrometheusQueryable(PrometheusOptions{Storage: fetcher})
+	meta := &block.ResultMetadata{}
+	querier, err := queryable.QuerierWithMetadata(0, 0, meta)
+	require.NoError(t, err)
+	defer querier.Close()
+
+	set := querier.Select(false, nil, labels.MustNewMatcher(labels.MatchEqual, "__name__", "cpu_native_histogram"))
+	require.True(t, set.Next())
+
+	require.False(t, meta.SawNativeHistogramSample)
+}
+
+func TestPrometheusQuerierSelectRecordsMixedHistogramTypes(t *testing.T) {
+	h := &writev2.Histogram{Sum: 7, Timestamp: 1700000000000}
+	annotation, err := EncodeNativeHistogramAnnotation(h)
+	require.NoError(t, err)
+
+	fetcher := &fakeSeriesFetcher{series: []FetchedSeries{
+		{
+			Tags: tagsOf("__name__", "cpu_native_histogram"),
+			Datapoints: ts.Datapoints{
+				{Timestamp: xtime.FromSeconds(1700000000), Value: h.Sum, Annotation: annotation},
+			},
+		},
+		{
+			Tags: tagsOf("__name__", "cpu_bucket", "le", "1.0"),
+			Datapoints: ts.Datapoints{
+				{Timestamp: xtime.FromSeconds(1700000000), Value: 3},
+			},
+		},
+	}}
+
+	queryable := NewPrometheusQueryable(PrometheusOptions{Storage: fetcher, EnableNativeHistograms: true})
+	meta := &block.ResultMetadata{}
+	querier, err := queryable.QuerierWithMetadata(0, 0, meta)
+	require.NoError(t, err)
+	defer querier.Close()
+
+	set := querier.Select(false, nil)
+	for set.Next() {
+	}
+	require.NoError(t, set.Err())
+
+	require.True(t, meta.IsMixedHistogramType())
+}